@@ -0,0 +1,293 @@
+package samlidp
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// importRecord is one line of a `POST /users:import` stream, in either
+// NDJSON or CSV form. Line is the 1-based source line it was parsed
+// from, set by parseUserImportNDJSON/parseUserImportCSV rather than
+// derived from the record's position in the returned slice, since blank
+// lines and parse failures mean the two don't otherwise line up.
+type importRecord struct {
+	Line              int      `json:"-"`
+	Name              string   `json:"name"`
+	Password          string   `json:"password"`
+	Email             string   `json:"email,omitempty"`
+	CommonName        string   `json:"common_name,omitempty"`
+	Surname           string   `json:"surname,omitempty"`
+	GivenName         string   `json:"given_name,omitempty"`
+	ScopedAffiliation string   `json:"scoped_affiliation,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// importLineError reports a problem with a single line of an import
+// stream, numbered from 1 so it lines up with what an operator sees in
+// the source file.
+type importLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// HandlePostUsersImport handles the `POST /users:import` request. The
+// body is an NDJSON stream of importRecord objects, or, when
+// Content-Type contains "csv", a CSV stream with a header row of the
+// same field names (Groups as a single ";"-separated column). Every
+// line is validated and hashed before anything is written to Store, so
+// a single bad line reports its error without partially importing the
+// rest. Store has no transaction primitive, so if a write fails partway
+// through the batch, every upsert already done for this request is
+// undone on a best-effort basis before the error is reported: a user
+// the batch created is deleted, and one it updated is restored to its
+// previous value.
+func (s *Server) HandlePostUsersImport(w http.ResponseWriter, r *http.Request) {
+	var records []importRecord
+	var lineErrors []importLineError
+	if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		records, lineErrors = parseUserImportCSV(r.Body)
+	} else {
+		records, lineErrors = parseUserImportNDJSON(r.Body)
+	}
+	if len(lineErrors) > 0 {
+		writeImportErrors(w, lineErrors)
+		return
+	}
+
+	users := make([]*User, 0, len(records))
+	for _, rec := range records {
+		if rec.Name == "" {
+			lineErrors = append(lineErrors, importLineError{Line: rec.Line, Error: "name is required"})
+			continue
+		}
+		if rec.Password == "" {
+			lineErrors = append(lineErrors, importLineError{Line: rec.Line, Error: "password is required"})
+			continue
+		}
+		hash, err := s.Passwords.hasher().Hash(rec.Password)
+		if err != nil {
+			lineErrors = append(lineErrors, importLineError{Line: rec.Line, Error: err.Error()})
+			continue
+		}
+		users = append(users, &User{
+			Name:              rec.Name,
+			Password:          hash,
+			Email:             rec.Email,
+			CommonName:        rec.CommonName,
+			Surname:           rec.Surname,
+			GivenName:         rec.GivenName,
+			ScopedAffiliation: rec.ScopedAffiliation,
+			Groups:            rec.Groups,
+		})
+	}
+	if len(lineErrors) > 0 {
+		writeImportErrors(w, lineErrors)
+		return
+	}
+
+	committed := make([]committedImportUser, 0, len(users))
+	for _, user := range users {
+		previous, err := s.existingUser(user.Name)
+		if err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			s.rollbackImport(committed)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.putUser(user.Name, user); err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			s.rollbackImport(committed)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		committed = append(committed, committedImportUser{name: user.Name, previous: previous})
+	}
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Imported int `json:"imported"`
+	}{Imported: len(users)}); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// committedImportUser records, for one user written during a
+// HandlePostUsersImport batch, the record that occupied its Store key
+// before the import touched it, so a rollback can restore rather than
+// destroy an account the import merely updated.
+type committedImportUser struct {
+	name     string
+	previous *User // nil if the import created name rather than updating it
+}
+
+// existingUser returns the user currently stored at name, or nil if
+// none exists yet.
+func (s *Server) existingUser(name string) (*User, error) {
+	user := User{}
+	err := s.Store.Get(fmt.Sprintf("/users/%s", name), &user)
+	switch err {
+	case nil:
+		return &user, nil
+	case ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// rollbackImport undoes the partial effect of a HandlePostUsersImport
+// batch that failed partway through writing: a user the import created
+// is deleted, and one it updated is restored to its previous value, so
+// the "upsert" in the doc comment above stays true even on a partial
+// failure. Writes are undone newest first, so a name that appears more
+// than once in the batch ends up at its value from before the import.
+// Failures here are logged rather than returned since the caller is
+// already reporting the original write error.
+func (s *Server) rollbackImport(committed []committedImportUser) {
+	for i := len(committed) - 1; i >= 0; i-- {
+		c := committed[i]
+		if c.previous == nil {
+			if err := s.Store.Delete(fmt.Sprintf("/users/%s", c.name)); err != nil {
+				s.logger.Printf("ERROR: rollback delete %s: %s", c.name, err)
+				continue
+			}
+			s.groups.remove(c.name)
+			continue
+		}
+		if err := s.putUser(c.name, c.previous); err != nil {
+			s.logger.Printf("ERROR: rollback restore %s: %s", c.name, err)
+		}
+	}
+}
+
+func writeImportErrors(w http.ResponseWriter, lineErrors []importLineError) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Errors []importLineError `json:"errors"`
+	}{Errors: lineErrors})
+}
+
+func parseUserImportNDJSON(body io.Reader) ([]importRecord, []importLineError) {
+	var records []importRecord
+	var lineErrors []importLineError
+
+	scanner := bufio.NewScanner(body)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		rec := importRecord{Line: line}
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			lineErrors = append(lineErrors, importLineError{Line: line, Error: err.Error()})
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, lineErrors
+}
+
+var importCSVColumns = []string{"name", "password", "email", "common_name", "surname", "given_name", "scoped_affiliation", "groups"}
+
+func parseUserImportCSV(body io.Reader) ([]importRecord, []importLineError) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, []importLineError{{Line: 1, Error: err.Error()}}
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.TrimSpace(name)] = i
+	}
+
+	get := func(row []string, name string) string {
+		i, ok := col[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+
+	var records []importRecord
+	var lineErrors []importLineError
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if parseErr, ok := err.(*csv.ParseError); ok {
+				lineErrors = append(lineErrors, importLineError{Line: parseErr.Line, Error: err.Error()})
+			} else {
+				lineErrors = append(lineErrors, importLineError{Error: err.Error()})
+			}
+			continue
+		}
+
+		// FieldPos reports the actual source line the row started on,
+		// which encoding/csv's own line counting (it silently skips
+		// blank lines and can span several source lines per record)
+		// otherwise makes impossible to reconstruct from the outside.
+		line, _ := reader.FieldPos(0)
+		rec := importRecord{
+			Line:              line,
+			Name:              get(row, "name"),
+			Password:          get(row, "password"),
+			Email:             get(row, "email"),
+			CommonName:        get(row, "common_name"),
+			Surname:           get(row, "surname"),
+			GivenName:         get(row, "given_name"),
+			ScopedAffiliation: get(row, "scoped_affiliation"),
+		}
+		if groups := get(row, "groups"); groups != "" {
+			rec.Groups = strings.Split(groups, ";")
+		}
+		records = append(records, rec)
+	}
+	return records, lineErrors
+}
+
+// HandleGetUsersExport handles the `GET /users:export` request and
+// streams every stored user as NDJSON. Password, HashedPassword, and
+// TOTPSecret are redacted unless the caller passes
+// `?include_secrets=true`, which is meant only for operator-run backups.
+func (s *Server) HandleGetUsersExport(w http.ResponseWriter, r *http.Request) {
+	includeSecrets := r.URL.Query().Get("include_secrets") == "true"
+
+	names, err := s.Store.List("/users/")
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, name := range names {
+		user := User{}
+		if err := s.Store.Get(fmt.Sprintf("/users/%s", name), &user); err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			continue
+		}
+		user.PlaintextPassword = nil
+		if !includeSecrets {
+			user.Password = ""
+			user.HashedPassword = nil
+			user.TOTPSecret = ""
+		}
+		if err := enc.Encode(user); err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			return
+		}
+	}
+}
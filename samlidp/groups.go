@@ -0,0 +1,151 @@
+package samlidp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// groupIndex is an in-memory reverse index from group name to member
+// usernames, derived from every stored user's Groups field. It is
+// populated lazily on first use and kept in sync afterwards by every
+// path that writes a user through s.putUser or removes one via
+// HandleDeleteUser, so HandleListGroups and HandleGetGroupMembers don't
+// need to re-scan the Store on every request.
+type groupIndex struct {
+	mu      sync.RWMutex
+	loaded  bool
+	byGroup map[string]map[string]bool
+}
+
+func newGroupIndex() *groupIndex {
+	return &groupIndex{byGroup: map[string]map[string]bool{}}
+}
+
+func (idx *groupIndex) ensureLoaded(s *Server) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.loaded {
+		return nil
+	}
+
+	names, err := s.Store.List("/users/")
+	if err != nil {
+		return err
+	}
+	byGroup := map[string]map[string]bool{}
+	for _, name := range names {
+		user := User{}
+		if err := s.Store.Get(fmt.Sprintf("/users/%s", name), &user); err != nil {
+			continue
+		}
+		addToIndex(byGroup, user.Name, user.Groups)
+	}
+	idx.byGroup = byGroup
+	idx.loaded = true
+	return nil
+}
+
+func addToIndex(byGroup map[string]map[string]bool, username string, groups []string) {
+	for _, group := range groups {
+		if byGroup[group] == nil {
+			byGroup[group] = map[string]bool{}
+		}
+		byGroup[group][username] = true
+	}
+}
+
+func removeFromIndex(byGroup map[string]map[string]bool, username string) {
+	for group, members := range byGroup {
+		delete(members, username)
+		if len(members) == 0 {
+			delete(byGroup, group)
+		}
+	}
+}
+
+// update replaces username's group memberships, e.g. after HandlePutUser
+// stores a new revision of the user.
+func (idx *groupIndex) update(username string, groups []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.loaded {
+		return
+	}
+	removeFromIndex(idx.byGroup, username)
+	addToIndex(idx.byGroup, username, groups)
+}
+
+// remove drops username from every group, e.g. after HandleDeleteUser.
+func (idx *groupIndex) remove(username string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.loaded {
+		return
+	}
+	removeFromIndex(idx.byGroup, username)
+}
+
+func (idx *groupIndex) groups() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	names := make([]string, 0, len(idx.byGroup))
+	for group := range idx.byGroup {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (idx *groupIndex) members(group string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	names := make([]string, 0, len(idx.byGroup[group]))
+	for name := range idx.byGroup[group] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HandleListGroups handles the `GET /groups/` request and responds with
+// the distinct group names derived from every stored user's Groups
+// field.
+func (s *Server) HandleListGroups(w http.ResponseWriter, _ *http.Request) {
+	if err := s.groups.ensureLoaded(s); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(struct {
+		Groups []string `json:"groups"`
+	}{Groups: s.groups.groups()})
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleGetGroupMembers handles the `GET /groups/:name/members` request
+// and responds with the names of users whose Groups field includes
+// `:name`.
+func (s *Server) HandleGetGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if err := s.groups.ensureLoaded(s); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(struct {
+		Members []string `json:"members"`
+	}{Members: s.groups.members(r.PathValue("name"))})
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,326 @@
+package samlidp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes and verifies passwords, encoding the result as a
+// self-describing PHC string (e.g.
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>") so a stored hash can
+// always be verified regardless of which algorithm or parameters created
+// it.
+type PasswordHasher interface {
+	// Hash returns the PHC-formatted hash of password using this
+	// hasher's current algorithm and parameters.
+	Hash(password string) (string, error)
+
+	// Verify reports whether password matches hash. It returns an error
+	// only when hash is malformed, never for a merely non-matching
+	// password.
+	Verify(hash, password string) (bool, error)
+
+	// CurrentParams reports whether hash was already produced with this
+	// hasher's algorithm and parameters, so the caller can tell a
+	// stale hash apart from one that matches the current policy.
+	CurrentParams(hash string) bool
+}
+
+// PasswordPolicy configures which PasswordHasher is used to hash newly
+// set and transparently rehashed passwords, along with the
+// algorithm-specific cost knobs operators tune to their hardware.
+type PasswordPolicy struct {
+	// Algorithm selects the hasher: "bcrypt", "scrypt", or "argon2id".
+	// Defaults to "argon2id" when empty.
+	Algorithm string
+
+	BcryptCost int
+
+	ScryptN, ScryptR, ScryptP int
+
+	Argon2Memory      uint32 // KiB
+	Argon2Time        uint32
+	Argon2Parallelism uint8
+}
+
+func (p PasswordPolicy) hasher() PasswordHasher {
+	switch p.Algorithm {
+	case "bcrypt":
+		cost := p.BcryptCost
+		if cost == 0 {
+			cost = bcrypt.DefaultCost
+		}
+		return &bcryptHasher{cost: cost}
+	case "scrypt":
+		h := &scryptHasher{n: p.ScryptN, r: p.ScryptR, p: p.ScryptP}
+		if h.n == 0 {
+			h.n = 32768
+		}
+		if h.r == 0 {
+			h.r = 8
+		}
+		if h.p == 0 {
+			h.p = 1
+		}
+		return h
+	default:
+		h := &argon2idHasher{memory: p.Argon2Memory, time: p.Argon2Time, parallelism: p.Argon2Parallelism}
+		if h.memory == 0 {
+			h.memory = 64 * 1024
+		}
+		if h.time == 0 {
+			h.time = 3
+		}
+		if h.parallelism == 0 {
+			h.parallelism = 2
+		}
+		return h
+	}
+}
+
+// VerifyPassword checks password against hash, dispatching on hash's PHC
+// or bcrypt prefix. It returns an error only for a hash in a format it
+// doesn't recognize or one that is malformed, never for a merely
+// non-matching password.
+func VerifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return (&argon2idHasher{}).Verify(hash, password)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return (&scryptHasher{}).Verify(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return (&bcryptHasher{}).Verify(hash, password)
+	default:
+		return false, fmt.Errorf("samlidp: unrecognized password hash format")
+	}
+}
+
+// verifyPassword checks password against user's stored hash, preferring
+// the self-describing Password field and falling back to the legacy
+// bcrypt-only HashedPassword for users created before PHC-format hashes
+// existed. When verification succeeds against a hash that doesn't match
+// s.Passwords' current algorithm or parameters, it transparently
+// rehashes the password and persists the update.
+func (s *Server) verifyPassword(user *User, password string) (bool, error) {
+	hash := user.Password
+	if hash == "" && len(user.HashedPassword) > 0 {
+		hash = string(user.HashedPassword)
+	}
+	if hash == "" {
+		return false, nil
+	}
+
+	ok, err := VerifyPassword(hash, password)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	hasher := s.Passwords.hasher()
+	if !hasher.CurrentParams(hash) {
+		newHash, err := hasher.Hash(password)
+		if err != nil {
+			s.logger.Printf("ERROR: rehash failed: %s", err)
+			return true, nil
+		}
+		user.Password = newHash
+		user.HashedPassword = nil
+		if err := s.Store.Put(fmt.Sprintf("/users/%s", user.Name), user); err != nil {
+			s.logger.Printf("ERROR: %s", err)
+		}
+	}
+	return true, nil
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func constantTimeEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// bcryptHasher implements PasswordHasher using bcrypt. bcrypt's own
+// output ("$2a$10$<salt+hash>") is already a self-describing PHC-style
+// string, so Hash and Verify pass through to golang.org/x/crypto/bcrypt
+// directly.
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	cost := h.cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch err {
+	case nil:
+		return true, nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (h *bcryptHasher) CurrentParams(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false
+	}
+	want := h.cost
+	if want == 0 {
+		want = bcrypt.DefaultCost
+	}
+	return cost == want
+}
+
+// scryptHasher implements PasswordHasher using scrypt, encoding
+// parameters and the random salt in an argon2-style PHC string:
+// "$scrypt$n=32768,r=8,p=1$<salt>$<hash>".
+type scryptHasher struct {
+	n, r, p int
+}
+
+const scryptKeyLen = 32
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	sum, err := scrypt.Key([]byte(password), salt, h.n, h.r, h.p, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$n=%d,r=%d,p=%d$%s$%s",
+		h.n, h.r, h.p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(sum),
+	), nil
+}
+
+func (h *scryptHasher) Verify(hash, password string) (bool, error) {
+	n, r, p, salt, sum, err := parseScryptHash(hash)
+	if err != nil {
+		return false, err
+	}
+	got, err := scrypt.Key([]byte(password), salt, n, r, p, len(sum))
+	if err != nil {
+		return false, err
+	}
+	return constantTimeEqual(got, sum), nil
+}
+
+func (h *scryptHasher) CurrentParams(hash string) bool {
+	n, r, p, _, _, err := parseScryptHash(hash)
+	if err != nil {
+		return false
+	}
+	return n == h.n && r == h.r && p == h.p
+}
+
+func parseScryptHash(hash string) (n, r, p int, salt, sum []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return 0, 0, 0, nil, nil, fmt.Errorf("samlidp: malformed scrypt hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "n=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("samlidp: malformed scrypt params: %w", err)
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	sum, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	return n, r, p, salt, sum, nil
+}
+
+// argon2idHasher implements PasswordHasher using Argon2id, the current
+// default policy.
+type argon2idHasher struct {
+	memory      uint32
+	time        uint32
+	parallelism uint8
+}
+
+const argon2KeyLen = 32
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	sum := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.parallelism, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(sum),
+	), nil
+}
+
+func (h *argon2idHasher) Verify(hash, password string) (bool, error) {
+	version, memory, time, parallelism, salt, sum, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("samlidp: unsupported argon2 version %d", version)
+	}
+	got := argon2.IDKey([]byte(password), salt, time, memory, parallelism, uint32(len(sum)))
+	return constantTimeEqual(got, sum), nil
+}
+
+func (h *argon2idHasher) CurrentParams(hash string) bool {
+	_, memory, time, parallelism, _, _, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	return memory == h.memory && time == h.time && parallelism == h.parallelism
+}
+
+func parseArgon2idHash(hash string) (version int, memory, time uint32, parallelism uint8, salt, sum []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return 0, 0, 0, 0, nil, nil, fmt.Errorf("samlidp: malformed argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return 0, 0, 0, 0, nil, nil, fmt.Errorf("samlidp: malformed argon2id version: %w", err)
+	}
+	var p int
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &p); err != nil {
+		return 0, 0, 0, 0, nil, nil, fmt.Errorf("samlidp: malformed argon2id params: %w", err)
+	}
+	parallelism = uint8(p)
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, 0, nil, nil, err
+	}
+	sum, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return 0, 0, 0, 0, nil, nil, err
+	}
+	return version, memory, time, parallelism, salt, sum, nil
+}
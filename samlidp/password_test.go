@@ -0,0 +1,126 @@
+package samlidp
+
+import "testing"
+
+func TestArgon2idHashVerifyRoundTrip(t *testing.T) {
+	h := &argon2idHasher{memory: 8 * 1024, time: 1, parallelism: 1}
+	hash, err := h.Hash("correct password")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+
+	ok, err := h.Verify(hash, "correct password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if !ok {
+		t.Fatalf("Verify rejected the password it was hashed with")
+	}
+
+	ok, err = h.Verify(hash, "wrong password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if ok {
+		t.Fatalf("Verify accepted the wrong password")
+	}
+
+	if !h.CurrentParams(hash) {
+		t.Fatalf("CurrentParams rejected a hash produced by the same hasher")
+	}
+	stale := &argon2idHasher{memory: 16 * 1024, time: 1, parallelism: 1}
+	if stale.CurrentParams(hash) {
+		t.Fatalf("CurrentParams accepted a hash with different params")
+	}
+}
+
+func TestScryptHashVerifyRoundTrip(t *testing.T) {
+	h := &scryptHasher{n: 16, r: 8, p: 1}
+	hash, err := h.Hash("correct password")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+
+	ok, err := h.Verify(hash, "correct password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if !ok {
+		t.Fatalf("Verify rejected the password it was hashed with")
+	}
+
+	ok, err = h.Verify(hash, "wrong password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if ok {
+		t.Fatalf("Verify accepted the wrong password")
+	}
+
+	if !h.CurrentParams(hash) {
+		t.Fatalf("CurrentParams rejected a hash produced by the same hasher")
+	}
+	stale := &scryptHasher{n: 32, r: 8, p: 1}
+	if stale.CurrentParams(hash) {
+		t.Fatalf("CurrentParams accepted a hash with different params")
+	}
+}
+
+func TestBcryptHashVerifyRoundTrip(t *testing.T) {
+	h := &bcryptHasher{cost: 4}
+	hash, err := h.Hash("correct password")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+
+	ok, err := h.Verify(hash, "correct password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if !ok {
+		t.Fatalf("Verify rejected the password it was hashed with")
+	}
+
+	ok, err = h.Verify(hash, "wrong password")
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if ok {
+		t.Fatalf("Verify accepted the wrong password")
+	}
+
+	if !h.CurrentParams(hash) {
+		t.Fatalf("CurrentParams rejected a hash produced by the same hasher")
+	}
+	stale := &bcryptHasher{cost: 5}
+	if stale.CurrentParams(hash) {
+		t.Fatalf("CurrentParams accepted a hash with a different cost")
+	}
+}
+
+func TestVerifyPasswordDispatchesOnPrefix(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"argon2id": &argon2idHasher{memory: 8 * 1024, time: 1, parallelism: 1},
+		"scrypt":   &scryptHasher{n: 16, r: 8, p: 1},
+		"bcrypt":   &bcryptHasher{cost: 4},
+	}
+	for name, h := range hashers {
+		hash, err := h.Hash("correct password")
+		if err != nil {
+			t.Fatalf("%s: Hash: %s", name, err)
+		}
+		ok, err := VerifyPassword(hash, "correct password")
+		if err != nil {
+			t.Fatalf("%s: VerifyPassword: %s", name, err)
+		}
+		if !ok {
+			t.Fatalf("%s: VerifyPassword rejected the password it was hashed with", name)
+		}
+	}
+}
+
+func TestVerifyPasswordUnrecognizedFormat(t *testing.T) {
+	if _, err := VerifyPassword("not a hash", "anything"); err == nil {
+		t.Fatalf("VerifyPassword accepted an unrecognized hash format")
+	}
+}
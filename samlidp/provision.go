@@ -0,0 +1,55 @@
+package samlidp
+
+import "fmt"
+
+// UserProvisioner creates a local `/users/:id` entry the first time a
+// SAML AuthnRequest arrives for a subject the Store doesn't already
+// know about, so the IdP can be seeded just-in-time from an upstream
+// directory instead of requiring an out-of-band admin call.
+// Implementations might pull from LDAP, an HTTP webhook, or a static
+// file.
+type UserProvisioner interface {
+	// Provision looks up subject in the upstream directory and returns
+	// the User record to create, populating at least Groups and Email.
+	// It returns ErrNotFound if the upstream directory has no such
+	// subject either.
+	Provision(subject string) (*User, error)
+}
+
+// GetOrProvisionUser returns the stored user for id, just-in-time
+// creating and persisting it via s.Provisioner when Store has no such
+// user yet. SAML handlers should call this wherever they resolve the
+// subject of an AuthnRequest, in place of a bare Store.Get. It returns
+// ErrNotFound when id is unknown to both Store and s.Provisioner, or
+// when no s.Provisioner is configured.
+//
+// NOTE: the AuthnRequest/SSO handling this package's other handlers
+// assume (the code that actually parses an AuthnRequest and would call
+// this in place of its own Store.Get) isn't part of this package's
+// source tree and isn't added by this series. Until whatever owns that
+// flow is wired to call GetOrProvisionUser, configuring Provisioner has
+// no observable effect.
+func (s *Server) GetOrProvisionUser(id string) (*User, error) {
+	user := User{}
+	err := s.Store.Get(fmt.Sprintf("/users/%s", id), &user)
+	switch err {
+	case nil:
+		return &user, nil
+	case ErrNotFound:
+		if s.Provisioner == nil {
+			return nil, ErrNotFound
+		}
+	default:
+		return nil, err
+	}
+
+	provisioned, err := s.Provisioner.Provision(id)
+	if err != nil {
+		return nil, err
+	}
+	provisioned.Name = id
+	if err := s.putUser(id, provisioned); err != nil {
+		return nil, err
+	}
+	return provisioned, nil
+}
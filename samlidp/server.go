@@ -0,0 +1,77 @@
+package samlidp
+
+import (
+	"errors"
+	"log"
+)
+
+// ErrNotFound is returned by Store.Get when key does not exist.
+var ErrNotFound = errors.New("samlidp: not found")
+
+// Store persists samlidp's data as JSON-encoded values under
+// hierarchical keys (e.g. "/users/alice"). Implementations may
+// optionally satisfy TotalCounter to let HandleListUsers report
+// X-Total-Count without enumerating every key.
+type Store interface {
+	// Get decodes the value stored at key into v, or returns
+	// ErrNotFound if key doesn't exist.
+	Get(key string, v interface{}) error
+
+	// Put encodes v and stores it at key, creating or overwriting any
+	// existing value.
+	Put(key string, v interface{}) error
+
+	// Delete removes the value at key, if any.
+	Delete(key string) error
+
+	// List returns the names stored under prefix, with prefix itself
+	// stripped from each.
+	List(prefix string) ([]string, error)
+}
+
+// Server implements samlidp's HTTP handlers against Store. Construct one
+// with NewServer rather than a bare Server{}: the handlers rely on
+// unexported state (the login rate limiter, among others) that only
+// NewServer initializes.
+type Server struct {
+	// Store persists users and their TOTP enrollment state.
+	Store Store
+
+	// Sessions issues and validates the cookie session HandleLogin
+	// establishes on success. Required for HandleLogin and HandleLogout;
+	// see CookieSessionProvider.
+	Sessions SessionProvider
+
+	// Passwords selects the password hashing algorithm and cost used for
+	// newly set and transparently rehashed passwords. The zero value is
+	// the default argon2id policy.
+	Passwords PasswordPolicy
+
+	// Provisioner, if set, lets GetOrProvisionUser JIT-create a local
+	// user record the first time it sees an unknown subject.
+	Provisioner UserProvisioner
+
+	logger       *log.Logger
+	loginLimiter *loginLimiter
+	totpReplay   *totpReplayCache
+	groups       *groupIndex
+}
+
+// NewServer constructs a Server backed by store, issuing sessions via
+// sessions and logging errors to logger (which defaults to log.Default()
+// when nil). Passwords defaults to the argon2id policy and Provisioner
+// to no JIT provisioning; set either field directly on the returned
+// *Server to change them.
+func NewServer(store Store, sessions SessionProvider, logger *log.Logger) *Server {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &Server{
+		Store:        store,
+		Sessions:     sessions,
+		logger:       logger,
+		loginLimiter: newLoginLimiter(),
+		totpReplay:   newTOTPReplayCache(),
+		groups:       newGroupIndex(),
+	}
+}
@@ -0,0 +1,196 @@
+package samlidp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrNoSession is returned by a SessionProvider when the request carries
+// no valid session.
+var ErrNoSession = errors.New("samlidp: no session")
+
+const defaultSessionCookieName = "saml_session"
+
+const defaultSessionTTL = 24 * time.Hour
+
+// SessionState is the information persisted for a logged in user. It is
+// intentionally small: enough to populate the SAML assertions the IdP
+// issues without a round trip to the Store on every request.
+type SessionState struct {
+	Username  string    `json:"username"`
+	Groups    []string  `json:"groups,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *SessionState) expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// SessionProvider issues and validates the sessions that the SAML flow
+// relies on to know a browser has already authenticated. The default
+// implementation, CookieSessionProvider, keeps the session state in the
+// cookie itself; a Store-backed implementation can be substituted to keep
+// session state on the server instead.
+type SessionProvider interface {
+	// New establishes a new session for user, writes the corresponding
+	// cookie to w, and returns the resulting SessionState.
+	New(w http.ResponseWriter, r *http.Request, user *User) (*SessionState, error)
+
+	// Get returns the session associated with r, or ErrNoSession if r
+	// carries no valid, unexpired session.
+	Get(r *http.Request) (*SessionState, error)
+
+	// Delete invalidates the session associated with r, if any, and
+	// clears the corresponding cookie on w.
+	Delete(w http.ResponseWriter, r *http.Request)
+}
+
+// CookieSessionProvider is a SessionProvider that stores the SessionState
+// directly in an AES-GCM encrypted and authenticated cookie, so the
+// server does not need to keep any session state of its own.
+type CookieSessionProvider struct {
+	// Name is the cookie name. Defaults to "saml_session" when empty.
+	Name string
+
+	// Secret is the 32-byte AES-256 key used to encrypt and authenticate
+	// session cookies. It must stay stable across restarts or previously
+	// issued sessions will stop validating.
+	Secret []byte
+
+	// TTL is how long an issued session remains valid. Defaults to 24
+	// hours when zero.
+	TTL time.Duration
+
+	// Secure controls whether the cookie is marked Secure. It should be
+	// true for any deployment served over HTTPS.
+	Secure bool
+}
+
+func (p *CookieSessionProvider) name() string {
+	if p.Name == "" {
+		return defaultSessionCookieName
+	}
+	return p.Name
+}
+
+func (p *CookieSessionProvider) ttl() time.Duration {
+	if p.TTL == 0 {
+		return defaultSessionTTL
+	}
+	return p.TTL
+}
+
+// New implements SessionProvider.
+func (p *CookieSessionProvider) New(w http.ResponseWriter, r *http.Request, user *User) (*SessionState, error) {
+	state := &SessionState{
+		Username:  user.Name,
+		Groups:    user.Groups,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(p.ttl()),
+	}
+	value, err := p.seal(state)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.name(),
+		Value:    value,
+		Path:     "/",
+		Expires:  state.ExpiresAt,
+		HttpOnly: true,
+		Secure:   p.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return state, nil
+}
+
+// Get implements SessionProvider.
+func (p *CookieSessionProvider) Get(r *http.Request) (*SessionState, error) {
+	cookie, err := r.Cookie(p.name())
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	state, err := p.unseal(cookie.Value)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	if state.expired() {
+		return nil, ErrNoSession
+	}
+	return state, nil
+}
+
+// Delete implements SessionProvider. It clears the cookie on w only: no
+// server-side state records the logout, so a copy of the cookie taken
+// earlier still validates until its ExpiresAt.
+func (p *CookieSessionProvider) Delete(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.name(),
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   p.Secure,
+	})
+}
+
+func (p *CookieSessionProvider) seal(state *SessionState) (string, error) {
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(p.Secret)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (p *CookieSessionProvider) unseal(value string) (*SessionState, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(p.Secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("samlidp: session cookie too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &SessionState{}
+	if err := json.Unmarshal(plaintext, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
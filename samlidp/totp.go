@@ -0,0 +1,253 @@
+package samlidp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// totpIssuer identifies this IdP in the otpauth:// URI shown to
+// authenticator apps during enrollment.
+const totpIssuer = "samlidp"
+
+const (
+	totpDigits    = 6
+	totpPeriod    = 30 * time.Second
+	totpSkewSteps = 1
+	totpEnrollTTL = 10 * time.Minute
+)
+
+// pendingTOTPEnrollment is the secret generated by HandlePostUserTOTPEnroll,
+// held under a separate store key until confirmed by
+// HandlePostUserTOTPVerify so an abandoned enrollment never overwrites the
+// user's existing, already-confirmed secret.
+type pendingTOTPEnrollment struct {
+	Secret    string    `json:"secret"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// totpReplayCache rejects any TOTP code for a time step that has already
+// been accepted for a given user. Because time steps are monotonically
+// increasing, remembering only the last accepted counter per user is
+// sufficient to catch replay of a captured code.
+type totpReplayCache struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+func newTOTPReplayCache() *totpReplayCache {
+	return &totpReplayCache{last: map[string]uint64{}}
+}
+
+func (c *totpReplayCache) accept(username string, counter uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counter <= c.last[username] {
+		return false
+	}
+	c.last[username] = counter
+	return true
+}
+
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20) // 160 bits, per RFC 4226 recommendation
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", int(totpPeriod.Seconds())))
+	label := url.PathEscape(fmt.Sprintf("%s:%s", totpIssuer, username))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// totpCode computes the RFC 6238 code for the given counter: HMAC-SHA1
+// over the 8-byte big-endian counter, dynamically truncated to 6 digits.
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := (uint32(sum[offset]&0x7f) << 24) | (uint32(sum[offset+1]) << 16) | (uint32(sum[offset+2]) << 8) | uint32(sum[offset+3])
+	return fmt.Sprintf("%0*d", totpDigits, truncated%pow10(totpDigits)), nil
+}
+
+func pow10(n int) uint32 {
+	p := uint32(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// validateTOTP checks code against secret for username, allowing
+// ±totpSkewSteps of clock drift, and consults replay to reject any
+// (username, counter) pair that was already accepted.
+func validateTOTP(secret, username, code string, replay *totpReplayCache) bool {
+	step := uint64(time.Now().Unix()) / uint64(totpPeriod.Seconds())
+	for skew := -totpSkewSteps; skew <= totpSkewSteps; skew++ {
+		counter := step + uint64(skew)
+		want, err := totpCode(secret, counter)
+		if err != nil {
+			return false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return replay.accept(username, counter)
+		}
+	}
+	return false
+}
+
+// HandlePostUserTOTPEnroll handles the `POST /users/:id/totp/enroll`
+// request. It generates a new TOTP secret, stashes it as a pending
+// enrollment, and returns an otpauth:// URI along with a QR code PNG
+// encoding that URI so it can be scanned by an authenticator app. The
+// secret is not attached to the user record until confirmed via
+// HandlePostUserTOTPVerify.
+func (s *Server) HandlePostUserTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	user := User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", id), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	pending := pendingTOTPEnrollment{Secret: secret, ExpiresAt: time.Now().Add(totpEnrollTTL)}
+	if err := s.Store.Put(fmt.Sprintf("/users/%s/totp/pending", id), &pending); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	uri := totpURI(id, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(struct {
+		URI   string `json:"uri"`
+		QRPng []byte `json:"qr_png"` // base64-encoded by encoding/json
+	}{URI: uri, QRPng: png})
+	if err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandlePostUserTOTPVerify handles the `POST /users/:id/totp/verify`
+// request. It accepts the JSON body `{"code": "..."}`, checks it against
+// the pending enrollment created by HandlePostUserTOTPEnroll, and on
+// success attaches the secret to the user record and clears the pending
+// enrollment.
+func (s *Server) HandlePostUserTOTPVerify(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	pending := pendingTOTPEnrollment{}
+	err := s.Store.Get(fmt.Sprintf("/users/%s/totp/pending", id), &pending)
+	switch err {
+	case nil:
+		// fall through
+	case ErrNotFound:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	default:
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if time.Now().After(pending.ExpiresAt) {
+		_ = s.Store.Delete(fmt.Sprintf("/users/%s/totp/pending", id))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if !validateTOTP(pending.Secret, id, req.Code, s.totpReplay) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	user := User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", id), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	user.TOTPSecret = pending.Secret
+	if err := s.Store.Put(fmt.Sprintf("/users/%s", id), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	_ = s.Store.Delete(fmt.Sprintf("/users/%s/totp/pending", id))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeleteUserTOTP handles the `DELETE /users/:id/totp` request,
+// letting an administrator reset a user's second factor, e.g. after a
+// lost device.
+func (s *Server) HandleDeleteUserTOTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	user := User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", id), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	user.TOTPSecret = ""
+	if err := s.Store.Put(fmt.Sprintf("/users/%s", id), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,122 @@
+package samlidp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func currentTOTPStep() uint64 {
+	return uint64(time.Now().Unix()) / uint64(totpPeriod.Seconds())
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret); err != nil {
+		t.Fatalf("secret %q is not valid base32: %s", secret, err)
+	}
+}
+
+func TestTOTPCodeIsDeterministicAndSixDigits(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+
+	code, err := totpCode(secret, 42)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if len(code) != totpDigits {
+		t.Fatalf("code %q has length %d, want %d", code, len(code), totpDigits)
+	}
+
+	again, err := totpCode(secret, 42)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if code != again {
+		t.Fatalf("totpCode(secret, 42) = %q then %q, want equal", code, again)
+	}
+
+	other, err := totpCode(secret, 43)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if code == other {
+		t.Fatalf("totpCode produced the same code for adjacent counters")
+	}
+}
+
+func TestValidateTOTPAcceptsCurrentStepAndSkew(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+	step := currentTOTPStep()
+
+	current, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if !validateTOTP(secret, "alice", current, newTOTPReplayCache()) {
+		t.Fatalf("validateTOTP rejected a code for the current step")
+	}
+
+	code, err := totpCode(secret, step-1)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if !validateTOTP(secret, "alice", code, newTOTPReplayCache()) {
+		t.Fatalf("validateTOTP rejected a code within the allowed clock skew")
+	}
+}
+
+func TestValidateTOTPRejectsOutsideSkew(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+	step := currentTOTPStep()
+
+	code, err := totpCode(secret, step-uint64(totpSkewSteps)-1)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+	if validateTOTP(secret, "alice", code, newTOTPReplayCache()) {
+		t.Fatalf("validateTOTP accepted a code outside the allowed clock skew")
+	}
+}
+
+func TestValidateTOTPRejectsWrongCode(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+	if validateTOTP(secret, "alice", "000000", newTOTPReplayCache()) {
+		t.Fatalf("validateTOTP accepted an arbitrary wrong code")
+	}
+}
+
+func TestValidateTOTPRejectsReplay(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %s", err)
+	}
+	step := currentTOTPStep()
+	code, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatalf("totpCode: %s", err)
+	}
+
+	replay := newTOTPReplayCache()
+	if !validateTOTP(secret, "alice", code, replay) {
+		t.Fatalf("validateTOTP rejected a fresh, correct code")
+	}
+	if validateTOTP(secret, "alice", code, replay) {
+		t.Fatalf("validateTOTP accepted a replayed code")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // User represents a stored user. The data here are used to
@@ -13,28 +15,134 @@ import (
 type User struct {
 	Name              string   `json:"name"`
 	PlaintextPassword *string  `json:"password,omitempty"` // not stored
-	HashedPassword    []byte   `json:"hashed_password,omitempty"`
+	Password          string   `json:"password_hash,omitempty"`
+	HashedPassword    []byte   `json:"hashed_password,omitempty"` // deprecated: legacy bcrypt-only hash, see Password
 	Groups            []string `json:"groups,omitempty"`
 	Email             string   `json:"email,omitempty"`
 	CommonName        string   `json:"common_name,omitempty"`
 	Surname           string   `json:"surname,omitempty"`
 	GivenName         string   `json:"given_name,omitempty"`
 	ScopedAffiliation string   `json:"scoped_affiliation,omitempty"`
+
+	// TOTPSecret is the base32-encoded shared secret for RFC 6238 TOTP
+	// second-factor authentication. It is empty until the user completes
+	// enrollment via HandlePostUserTOTPVerify.
+	TOTPSecret string `json:"totp_secret,omitempty"`
+
+	// UpdatedAt is set by HandlePutUser on every write and lets
+	// HandleListUsers answer `?updated_since=`.
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// TotalCounter is an optional interface a Store implementation can
+// satisfy to report how many entries exist under a prefix without
+// listing them all. When s.Store implements it, HandleListUsers uses it
+// to populate the X-Total-Count response header.
+type TotalCounter interface {
+	TotalCount(prefix string) (int, error)
 }
 
-// HandleListUsers handles the `GET /users/` request and responds with a JSON formatted list
-// of user names.
-func (s *Server) HandleListUsers(w http.ResponseWriter, _ *http.Request) {
-	users, err := s.Store.List("/users/")
+// HandleListUsers handles the `GET /users/` request and responds with a paginated JSON list of
+// user names as `{"users": [...], "next_cursor": "..."}`. It accepts the query parameters
+// `limit` (page size, default 100), `cursor` (an opaque value taken from a previous response's
+// next_cursor), `group` (only members of this group), `email_prefix` (only users whose Email
+// starts with this), and `updated_since` (an RFC 3339 timestamp; only users updated at or after
+// it). The X-Total-Count response header reports how many users match group/email_prefix/
+// updated_since in total, across all pages; if none of those filters are given, it's the count of
+// every user, taken from s.Store's TotalCount when it implements TotalCounter.
+func (s *Server) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	cursor := r.URL.Query().Get("cursor")
+	group := r.URL.Query().Get("group")
+	emailPrefix := r.URL.Query().Get("email_prefix")
+
+	var updatedSince time.Time
+	if v := r.URL.Query().Get("updated_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		updatedSince = t
+	}
+
+	names, err := s.Store.List("/users/")
 	if err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	sort.Strings(names)
+
+	var inGroup map[string]bool
+	if group != "" {
+		if err := s.groups.ensureLoaded(s); err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		inGroup = map[string]bool{}
+		for _, name := range s.groups.members(group) {
+			inGroup[name] = true
+		}
+	}
+
+	// matching counts every name that satisfies group/email_prefix/
+	// updated_since, independent of cursor, so X-Total-Count stays
+	// stable across pages instead of reporting the unfiltered store
+	// total while Users/next_cursor reflect the filtered subset.
+	filtersApplied := group != "" || emailPrefix != "" || !updatedSince.IsZero()
+	matching := 0
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		if group != "" && !inGroup[name] {
+			continue
+		}
+		if emailPrefix != "" || !updatedSince.IsZero() {
+			user := User{}
+			if err := s.Store.Get(fmt.Sprintf("/users/%s", name), &user); err != nil {
+				s.logger.Printf("ERROR: %s", err)
+				continue
+			}
+			if emailPrefix != "" && !strings.HasPrefix(user.Email, emailPrefix) {
+				continue
+			}
+			if !updatedSince.IsZero() && user.UpdatedAt.Before(updatedSince) {
+				continue
+			}
+		}
+		matching++
+		if cursor != "" && name <= cursor {
+			continue
+		}
+		filtered = append(filtered, name)
+	}
+
+	total := matching
+	if !filtersApplied {
+		if counter, ok := s.Store.(TotalCounter); ok {
+			if n, err := counter.TotalCount("/users/"); err == nil {
+				total = n
+			}
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	nextCursor := ""
+	if len(filtered) > limit {
+		nextCursor = filtered[limit-1]
+		filtered = filtered[:limit]
+	}
 
 	err = json.NewEncoder(w).Encode(struct {
-		Users []string `json:"users"`
-	}{Users: users})
+		Users      []string `json:"users"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}{Users: filtered, NextCursor: nextCursor})
 	if err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -43,7 +151,7 @@ func (s *Server) HandleListUsers(w http.ResponseWriter, _ *http.Request) {
 }
 
 // HandleGetUser handles the `GET /users/:id` request and responds with the user object in JSON
-// format. The HashedPassword field is excluded.
+// format. The Password, HashedPassword, and TOTPSecret fields are excluded.
 func (s *Server) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	user := User{}
 	err := s.Store.Get(fmt.Sprintf("/users/%s", r.PathValue("id")), &user)
@@ -52,7 +160,9 @@ func (s *Server) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	user.Password = ""
 	user.HashedPassword = nil
+	user.TOTPSecret = ""
 	if err := json.NewEncoder(w).Encode(user); err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -60,10 +170,22 @@ func (s *Server) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// putUser stores user under id and updates the group index to match, so
+// every path that writes a user record — not just HandlePutUser — keeps
+// HandleListGroups, HandleGetGroupMembers, and the `?group=` filter on
+// HandleListUsers accurate.
+func (s *Server) putUser(id string, user *User) error {
+	if err := s.Store.Put(fmt.Sprintf("/users/%s", id), user); err != nil {
+		return err
+	}
+	s.groups.update(user.Name, user.Groups)
+	return nil
+}
+
 // HandlePutUser handles the `PUT /users/:id` request. It accepts a JSON formatted user object in
 // the request body and stores it. If the PlaintextPassword field is present then it is hashed
-// and stored in HashedPassword. If the PlaintextPassword field is not present then
-// HashedPassword retains it's stored value.
+// with the server's current PasswordPolicy and stored in Password. If the PlaintextPassword
+// field is not present then the existing Password and HashedPassword retain their stored value.
 func (s *Server) HandlePutUser(w http.ResponseWriter, r *http.Request) {
 	user := User{}
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -74,18 +196,20 @@ func (s *Server) HandlePutUser(w http.ResponseWriter, r *http.Request) {
 	user.Name = r.PathValue("id")
 
 	if user.PlaintextPassword != nil {
-		var err error
-		user.HashedPassword, err = bcrypt.GenerateFromPassword([]byte(*user.PlaintextPassword), bcrypt.DefaultCost)
+		hash, err := s.Passwords.hasher().Hash(*user.PlaintextPassword)
 		if err != nil {
 			s.logger.Printf("ERROR: %s", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		user.Password = hash
+		user.HashedPassword = nil
 	} else {
 		existingUser := User{}
 		err := s.Store.Get(fmt.Sprintf("/users/%s", r.PathValue("id")), &existingUser)
 		switch err {
 		case nil:
+			user.Password = existingUser.Password
 			user.HashedPassword = existingUser.HashedPassword
 		case ErrNotFound:
 			// nop
@@ -96,9 +220,19 @@ func (s *Server) HandlePutUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	user.PlaintextPassword = nil
+	user.UpdatedAt = time.Now()
 
-	err := s.Store.Put(fmt.Sprintf("/users/%s", r.PathValue("id")), &user)
-	if err != nil {
+	// TOTPSecret changes only through the TOTP enrollment and reset
+	// handlers, never through the request body.
+	stored := User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", user.Name), &stored); err != nil && err != ErrNotFound {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	user.TOTPSecret = stored.TOTPSecret
+
+	if err := s.putUser(r.PathValue("id"), &user); err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
@@ -108,11 +242,13 @@ func (s *Server) HandlePutUser(w http.ResponseWriter, r *http.Request) {
 
 // HandleDeleteUser handles the `DELETE /users/:id` request.
 func (s *Server) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	err := s.Store.Delete(fmt.Sprintf("/users/%s", r.PathValue("id")))
+	id := r.PathValue("id")
+	err := s.Store.Delete(fmt.Sprintf("/users/%s", id))
 	if err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	s.groups.remove(id)
 	w.WriteHeader(http.StatusNoContent)
 }